@@ -0,0 +1,80 @@
+package messagepool
+
+import (
+	"encoding/json"
+
+	"github.com/ipfs/go-datastore"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+)
+
+var dskeyConfig = datastore.NewKey("/mpool/config")
+
+// MpoolConfig holds the user-tunable behavior of the message pool that
+// should survive a daemon restart.
+type MpoolConfig struct {
+	// PriorityAddrs are selected into a block ahead of everything else,
+	// regardless of gasPerf, up to the block gas limit. This lets a miner
+	// guarantee inclusion of its own messages (e.g. SubmitWindowedPoSt)
+	// even when the public mempool is congested with higher-fee traffic.
+	PriorityAddrs []address.Address
+
+	// MaxNonceGap is the furthest a message's nonce may sit ahead of its
+	// actor's expected next nonce before Push/Add reject it outright.
+	// Zero means DefaultMaxNonceGap.
+	MaxNonceGap uint64
+}
+
+func (mp *MessagePool) loadConfig(ds datastore.Datastore) (*MpoolConfig, error) {
+	have, err := ds.Has(dskeyConfig)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to check for mpool config: %w", err)
+	}
+	if !have {
+		return &MpoolConfig{}, nil
+	}
+
+	raw, err := ds.Get(dskeyConfig)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read mpool config: %w", err)
+	}
+
+	cfg := new(MpoolConfig)
+	if err := json.Unmarshal(raw, cfg); err != nil {
+		return nil, xerrors.Errorf("failed to unmarshal mpool config: %w", err)
+	}
+
+	return cfg, nil
+}
+
+func (mp *MessagePool) saveConfig(ds datastore.Datastore, cfg *MpoolConfig) error {
+	raw, err := json.Marshal(cfg)
+	if err != nil {
+		return xerrors.Errorf("failed to marshal mpool config: %w", err)
+	}
+
+	return ds.Put(dskeyConfig, raw)
+}
+
+// MpoolGetConfig returns the currently active configuration.
+func (mp *MessagePool) MpoolGetConfig() (*MpoolConfig, error) {
+	mp.lk.RLock()
+	defer mp.lk.RUnlock()
+
+	cfgCopy := *mp.cfg
+	return &cfgCopy, nil
+}
+
+// MpoolSetConfig persists cfg and makes it the active configuration.
+func (mp *MessagePool) MpoolSetConfig(cfg *MpoolConfig) error {
+	mp.lk.Lock()
+	defer mp.lk.Unlock()
+
+	if err := mp.saveConfig(mp.ds, cfg); err != nil {
+		return xerrors.Errorf("failed to save mpool config: %w", err)
+	}
+
+	mp.cfg = cfg
+	return nil
+}
@@ -0,0 +1,220 @@
+package messagepool
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	logging "github.com/ipfs/go-log/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/network"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+var log = logging.Logger("messagepool")
+
+// Provider is the interface that the message pool needs from the chain in
+// order to validate and select messages.
+type Provider interface {
+	SubscribeHeadChanges(func(rev, app []*types.TipSet) error) *types.TipSet
+
+	PutMessage(m types.ChainMsg) (cid.Cid, error)
+	PubSubPublish(string, []byte) error
+
+	GetActorAfter(addr address.Address, ts *types.TipSet) (*types.Actor, error)
+	StateNetworkVersion(ctx context.Context, height abi.ChainEpoch) network.Version
+
+	MessagesForBlock(h *types.BlockHeader) ([]*types.Message, []*types.SignedMessage, error)
+	MessagesForTipset(ts *types.TipSet) ([]types.ChainMsg, error)
+	LoadTipSet(tsk types.TipSetKey) (*types.TipSet, error)
+	ChainComputeBaseFee(ctx context.Context, ts *types.TipSet) (big.Int, error)
+}
+
+// MessagePool tracks pending messages for inclusion in the next block(s) and
+// is responsible for selecting the messages to include when asked to
+// propose a block.
+type MessagePool struct {
+	lk sync.RWMutex
+
+	ds      datastore.Batching
+	api     Provider
+	netName string
+
+	curTs *types.TipSet
+
+	cfg *MpoolConfig
+
+	// nextNonce tracks, per actor, the nonce an on-chain message from that
+	// actor is expected to carry next. It is seeded lazily from the state
+	// tree at curTs the first time an actor is seen, and kept in sync by
+	// HeadChange as blocks are applied and reverted.
+	nextNonce map[address.Address]uint64
+
+	pending map[address.Address]map[uint64]*types.SignedMessage
+
+	// appliedCache remembers, per applied tipset, the exact signed
+	// messages applyNonces removed from pending for it, so that a later
+	// revertNonces can restore them exactly rather than relying on
+	// whatever shape MessagesForTipset hands back for a BLS message (its
+	// signature lives in the block's aggregate, not on the message
+	// itself, once it's on chain). Bounded to appliedCacheDepth entries so
+	// tipsets that are never reverted don't accumulate here forever.
+	appliedCache map[types.TipSetKey]map[address.Address]map[uint64]*types.SignedMessage
+	appliedOrder []types.TipSetKey
+
+	localAddrs map[address.Address]struct{}
+
+	changes chan struct{}
+}
+
+// New creates a message pool bound to the given chain provider and
+// datastore. netName is the pubsub topic that Push publishes messages to;
+// ds holds the persisted MpoolConfig.
+func New(api Provider, ds datastore.Batching, netName string) (*MessagePool, error) {
+	mp := &MessagePool{
+		ds:           ds,
+		api:          api,
+		netName:      netName,
+		nextNonce:    make(map[address.Address]uint64),
+		pending:      make(map[address.Address]map[uint64]*types.SignedMessage),
+		appliedCache: make(map[types.TipSetKey]map[address.Address]map[uint64]*types.SignedMessage),
+		localAddrs:   make(map[address.Address]struct{}),
+		changes:      make(chan struct{}, 1),
+	}
+
+	cfg, err := mp.loadConfig(ds)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to load mpool config: %w", err)
+	}
+	mp.cfg = cfg
+
+	ts := api.SubscribeHeadChanges(func(rev, app []*types.TipSet) error {
+		return mp.HeadChange(rev, app)
+	})
+	mp.curTs = ts
+
+	return mp, nil
+}
+
+// HeadChange is called by the chain provider whenever the head of the chain
+// changes, so that the pool can drop messages that have already been
+// included on chain and re-add messages from reverted blocks.
+func (mp *MessagePool) HeadChange(revert, apply []*types.TipSet) error {
+	mp.lk.Lock()
+	defer mp.lk.Unlock()
+
+	for _, ts := range revert {
+		mp.revertNonces(ts)
+	}
+	for _, ts := range apply {
+		mp.curTs = ts
+		mp.applyNonces(ts)
+	}
+
+	return nil
+}
+
+func (mp *MessagePool) getPendingMset(a address.Address) map[uint64]*types.SignedMessage {
+	mset, ok := mp.pending[a]
+	if !ok {
+		return nil
+	}
+	return mset
+}
+
+// Add submits a signed message to the pool, to be considered for inclusion
+// in a future block.
+func (mp *MessagePool) Add(m *types.SignedMessage) error {
+	mp.lk.Lock()
+	defer mp.lk.Unlock()
+
+	return mp.addLocked(m)
+}
+
+// Push adds m to the pool and broadcasts it to the network.
+func (mp *MessagePool) Push(m *types.SignedMessage) (cid.Cid, error) {
+	mp.lk.Lock()
+	if err := mp.addLocked(m); err != nil {
+		mp.lk.Unlock()
+		return cid.Undef, err
+	}
+	mp.lk.Unlock()
+
+	msgb, err := m.Serialize()
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("failed to serialize message: %w", err)
+	}
+
+	if err := mp.api.PubSubPublish(mp.netName, msgb); err != nil {
+		return cid.Undef, xerrors.Errorf("failed to publish message: %w", err)
+	}
+
+	return m.Cid(), nil
+}
+
+func (mp *MessagePool) addLocked(m *types.SignedMessage) error {
+	if err := mp.checkNonceGap(m); err != nil {
+		return err
+	}
+
+	mset, ok := mp.pending[m.Message.From]
+	if !ok {
+		mset = make(map[uint64]*types.SignedMessage)
+		mp.pending[m.Message.From] = mset
+	}
+	mset[m.Message.Nonce] = m
+
+	return nil
+}
+
+func (mp *MessagePool) getStateBalance(addr address.Address, ts *types.TipSet) (big.Int, error) {
+	act, err := mp.api.GetActorAfter(addr, ts)
+	if err != nil {
+		return big.Zero(), xerrors.Errorf("failed to get actor: %w", err)
+	}
+
+	return act.Balance, nil
+}
+
+func (mp *MessagePool) getStateBaseFee(ctx context.Context, ts *types.TipSet) (big.Int, error) {
+	baseFee, err := mp.api.ChainComputeBaseFee(ctx, ts)
+	if err != nil {
+		return big.Zero(), xerrors.Errorf("failed to get basefee: %w", err)
+	}
+
+	return baseFee, nil
+}
+
+// SelectMessagesByTsk resolves tsk against the chain store and runs
+// SelectMessages against the resulting tipset.
+//
+// This is the piece an api.FullNode.MpoolSelect JSON-RPC method would call
+// into, so that an external block-producer process could drive selection
+// against an arbitrary target tipset on a running daemon without embedding
+// the pool itself; that RPC method, its FullNodeStruct/node-impl wiring,
+// and a `lotus mpool select` CLI command do not exist in this tree (there
+// is no api/ or cli/ package here at all) and are not added by this
+// function alone. This is only the pool-side entry point they'd call.
+func (mp *MessagePool) SelectMessagesByTsk(ctx context.Context, tsk types.TipSetKey, ticketQuality float64) ([]*types.SignedMessage, error) {
+	ts, err := mp.api.LoadTipSet(tsk)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to load tipset %s: %w", tsk, err)
+	}
+
+	return mp.SelectMessages(ctx, ts, ticketQuality)
+}
+
+func (mp *MessagePool) getStateNonce(addr address.Address, ts *types.TipSet) (uint64, error) {
+	act, err := mp.api.GetActorAfter(addr, ts)
+	if err != nil {
+		return 0, xerrors.Errorf("failed to get actor: %w", err)
+	}
+
+	return act.Nonce, nil
+}
@@ -0,0 +1,121 @@
+package messagepool
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/network"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// testMpoolAPI is a bare-bones in-memory stand-in for the chain Provider,
+// used to drive MessagePool in tests without a running chain store.
+type testMpoolAPI struct {
+	bmsgs        map[cid.Cid][]*types.SignedMessage
+	statenonce   map[address.Address]uint64
+	statebalance map[address.Address]big.Int
+	baseFee      big.Int
+	tipsets      map[types.TipSetKey]*types.TipSet
+	tsMessages   map[types.TipSetKey][]types.ChainMsg
+}
+
+func newTestMpoolAPI() *testMpoolAPI {
+	return &testMpoolAPI{
+		bmsgs:        make(map[cid.Cid][]*types.SignedMessage),
+		statenonce:   make(map[address.Address]uint64),
+		statebalance: make(map[address.Address]big.Int),
+		baseFee:      big.Zero(),
+		tipsets:      make(map[types.TipSetKey]*types.TipSet),
+		tsMessages:   make(map[types.TipSetKey][]types.ChainMsg),
+	}
+}
+
+// addTipSet registers ts so that a later LoadTipSet(ts.Key()) resolves it,
+// as a real chain store would.
+func (tma *testMpoolAPI) addTipSet(ts *types.TipSet) {
+	tma.tipsets[ts.Key()] = ts
+}
+
+// setTipSetMessages registers msgs as the messages included in ts, so that
+// a later MessagesForTipset(ts) returns them, as a real chain store would.
+func (tma *testMpoolAPI) setTipSetMessages(ts *types.TipSet, msgs ...*types.SignedMessage) {
+	chainMsgs := make([]types.ChainMsg, len(msgs))
+	for i, m := range msgs {
+		chainMsgs[i] = m
+	}
+	tma.tsMessages[ts.Key()] = chainMsgs
+}
+
+// setTipSetChainMsgs registers msgs as the messages included in ts in
+// whatever ChainMsg form the caller provides, unlike setTipSetMessages,
+// which always stores the fully signed form. It's meant for exercising the
+// on-chain shape a BLS message actually comes back as: a bare *types.Message
+// with no signature, since a BLS signature lives in the block's aggregate.
+func (tma *testMpoolAPI) setTipSetChainMsgs(ts *types.TipSet, msgs ...types.ChainMsg) {
+	tma.tsMessages[ts.Key()] = msgs
+}
+
+func (tma *testMpoolAPI) setBalance(a address.Address, fil uint64) {
+	tma.statebalance[a] = types.FromFil(fil)
+}
+
+func (tma *testMpoolAPI) setBalanceRaw(a address.Address, v big.Int) {
+	tma.statebalance[a] = v
+}
+
+func (tma *testMpoolAPI) setBaseFee(v big.Int) {
+	tma.baseFee = v
+}
+
+func (tma *testMpoolAPI) SubscribeHeadChanges(cb func(rev, app []*types.TipSet) error) *types.TipSet {
+	return nil
+}
+
+func (tma *testMpoolAPI) PutMessage(m types.ChainMsg) (cid.Cid, error) {
+	return m.Cid(), nil
+}
+
+func (tma *testMpoolAPI) PubSubPublish(string, []byte) error {
+	return nil
+}
+
+func (tma *testMpoolAPI) GetActorAfter(addr address.Address, ts *types.TipSet) (*types.Actor, error) {
+	nonce := tma.statenonce[addr]
+	balance := tma.statebalance[addr]
+
+	return &types.Actor{
+		Nonce:   nonce,
+		Balance: balance,
+	}, nil
+}
+
+func (tma *testMpoolAPI) StateNetworkVersion(ctx context.Context, height abi.ChainEpoch) network.Version {
+	return network.Version0
+}
+
+func (tma *testMpoolAPI) MessagesForBlock(h *types.BlockHeader) ([]*types.Message, []*types.SignedMessage, error) {
+	return nil, tma.bmsgs[h.Cid()], nil
+}
+
+func (tma *testMpoolAPI) MessagesForTipset(ts *types.TipSet) ([]types.ChainMsg, error) {
+	return tma.tsMessages[ts.Key()], nil
+}
+
+func (tma *testMpoolAPI) LoadTipSet(tsk types.TipSetKey) (*types.TipSet, error) {
+	ts, ok := tma.tipsets[tsk]
+	if !ok {
+		return nil, xerrors.Errorf("tipset %s not found", tsk)
+	}
+
+	return ts, nil
+}
+
+func (tma *testMpoolAPI) ChainComputeBaseFee(ctx context.Context, ts *types.TipSet) (big.Int, error) {
+	return tma.baseFee, nil
+}
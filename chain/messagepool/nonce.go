@@ -0,0 +1,231 @@
+package messagepool
+
+import (
+	"fmt"
+
+	"github.com/filecoin-project/go-address"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// DefaultMaxNonceGap is used whenever MpoolConfig.MaxNonceGap is unset
+// (zero). A message whose nonce is further than this past the actor's
+// expected next nonce is rejected outright, so that nonce-far-future spam
+// can't bloat the pool waiting for messages that may never arrive.
+const DefaultMaxNonceGap = 4
+
+// ErrNonceGap is returned by Push/Add when a message's nonce is further
+// ahead of the actor's expected next nonce than the pool's MaxNonceGap.
+type ErrNonceGap struct {
+	Addr     address.Address
+	Nonce    uint64
+	Expected uint64
+	MaxGap   uint64
+}
+
+func (e *ErrNonceGap) Error() string {
+	return fmt.Sprintf("message from %s has nonce %d, more than %d past the expected nonce %d",
+		e.Addr, e.Nonce, e.MaxGap, e.Expected)
+}
+
+func (mp *MessagePool) maxNonceGap() uint64 {
+	if mp.cfg.MaxNonceGap == 0 {
+		return DefaultMaxNonceGap
+	}
+	return mp.cfg.MaxNonceGap
+}
+
+// expectedNonce returns the cached next-nonce for addr, seeding it from
+// the state tree at curTs the first time addr is seen.
+func (mp *MessagePool) expectedNonce(addr address.Address) uint64 {
+	if n, ok := mp.nextNonce[addr]; ok {
+		return n
+	}
+
+	n, err := mp.getStateNonce(addr, mp.curTs)
+	if err != nil {
+		log.Warnf("failed to seed next nonce for %s: %s", addr, err)
+		n = 0
+	}
+
+	mp.nextNonce[addr] = n
+	return n
+}
+
+func (mp *MessagePool) checkNonceGap(m *types.SignedMessage) error {
+	expected := mp.expectedNonce(m.Message.From)
+	maxGap := mp.maxNonceGap()
+
+	if m.Message.Nonce > expected+maxGap {
+		return &ErrNonceGap{
+			Addr:     m.Message.From,
+			Nonce:    m.Message.Nonce,
+			Expected: expected,
+			MaxGap:   maxGap,
+		}
+	}
+
+	return nil
+}
+
+// appliedCacheDepth bounds how many applied tipsets' removed messages
+// appliedCache holds on to for a potential revert. Reorgs deeper than this
+// are rare enough that losing the ability to restore the original signed
+// form of a BLS message reverted that far back is an acceptable tradeoff
+// against holding every applied message in memory forever.
+const appliedCacheDepth = 64
+
+// applyNonces advances the next-nonce tracker for every actor with a
+// message included in ts, and drops those messages from pending: they're
+// on chain now, so there's nothing left to select them for. The exact
+// signed messages removed are stashed in appliedCache, keyed by ts, so
+// that revertNonces can restore them precisely if ts is later reverted.
+func (mp *MessagePool) applyNonces(ts *types.TipSet) {
+	msgs, err := mp.api.MessagesForTipset(ts)
+	if err != nil {
+		log.Warnf("failed to get messages for tipset %s: %s", ts.Key(), err)
+		return
+	}
+
+	removed := make(map[address.Address]map[uint64]*types.SignedMessage)
+
+	for _, m := range msgs {
+		from := m.VMMessage().From
+		nonce := m.VMMessage().Nonce
+		if nonce+1 > mp.nextNonce[from] {
+			mp.nextNonce[from] = nonce + 1
+		}
+
+		mset, ok := mp.pending[from]
+		if !ok {
+			continue
+		}
+		sm, ok := mset[nonce]
+		if !ok {
+			continue
+		}
+
+		if removed[from] == nil {
+			removed[from] = make(map[uint64]*types.SignedMessage)
+		}
+		removed[from][nonce] = sm
+
+		delete(mset, nonce)
+		if len(mset) == 0 {
+			delete(mp.pending, from)
+		}
+	}
+
+	if len(removed) > 0 {
+		mp.appliedCache[ts.Key()] = removed
+		mp.appliedOrder = append(mp.appliedOrder, ts.Key())
+		for len(mp.appliedOrder) > appliedCacheDepth {
+			delete(mp.appliedCache, mp.appliedOrder[0])
+			mp.appliedOrder = mp.appliedOrder[1:]
+		}
+	}
+}
+
+// revertNonces rewinds the next-nonce tracker for every actor with a
+// message included in the reverted ts, undoing applyNonces, and gives
+// those messages another chance at inclusion by putting them back in
+// pending.
+//
+// A tipset's messages for a given actor are always a contiguous run
+// starting at the nonce the actor's next-nonce tracker held just before
+// the tipset was applied, so the correct rewind is to the lowest nonce
+// seen for that actor here -- not a single conditional decrement, which
+// only undoes one step and leaves the tracker wrong whenever an actor had
+// more than one message in the reverted tipset.
+func (mp *MessagePool) revertNonces(ts *types.TipSet) {
+	msgs, err := mp.api.MessagesForTipset(ts)
+	if err != nil {
+		log.Warnf("failed to get messages for tipset %s: %s", ts.Key(), err)
+		return
+	}
+
+	cached := mp.appliedCache[ts.Key()]
+	delete(mp.appliedCache, ts.Key())
+
+	lowest := make(map[address.Address]uint64)
+	seen := make(map[address.Address]bool)
+
+	for _, m := range msgs {
+		from := m.VMMessage().From
+		nonce := m.VMMessage().Nonce
+
+		if !seen[from] || nonce < lowest[from] {
+			lowest[from] = nonce
+			seen[from] = true
+		}
+
+		// MessagesForTipset hands a BLS message back in its on-chain,
+		// unsigned form (the aggregate signature lives on the block, not
+		// the message), so it can't be restored to pending as-is; fall
+		// back to the signed form we stashed when it was applied.
+		sm, ok := m.(*types.SignedMessage)
+		if !ok {
+			sm, ok = cached[from][nonce]
+			if !ok {
+				log.Warnf("could not restore reverted message from %s at nonce %d to pending: original signed form unavailable", from, nonce)
+				continue
+			}
+		}
+
+		mset, ok := mp.pending[from]
+		if !ok {
+			mset = make(map[uint64]*types.SignedMessage)
+			mp.pending[from] = mset
+		}
+		mset[nonce] = sm
+	}
+
+	for from, nonce := range lowest {
+		mp.nextNonce[from] = nonce
+	}
+}
+
+// PendingStats summarizes the state of an actor's pending messages for
+// debugging: the nonce its next message is expected to carry, how many
+// messages it currently has pending, and how many nonces between the
+// expected nonce and its highest pending nonce are missing.
+type PendingStats struct {
+	ExpectedNonce uint64
+	PendingCount  int
+	GapCount      int
+}
+
+// MpoolPendingStats returns, for every actor with pending messages, a
+// summary of its expected nonce and how contiguous its pending messages
+// are. It's meant as a debug aid for diagnosing stuck or gapped actors.
+func (mp *MessagePool) MpoolPendingStats() map[address.Address]PendingStats {
+	mp.lk.Lock()
+	defer mp.lk.Unlock()
+
+	stats := make(map[address.Address]PendingStats, len(mp.pending))
+	for addr, mset := range mp.pending {
+		expected := mp.expectedNonce(addr)
+
+		var maxNonce uint64
+		for nonce := range mset {
+			if nonce > maxNonce {
+				maxNonce = nonce
+			}
+		}
+
+		gaps := 0
+		for n := expected; n <= maxNonce; n++ {
+			if _, ok := mset[n]; !ok {
+				gaps++
+			}
+		}
+
+		stats[addr] = PendingStats{
+			ExpectedNonce: expected,
+			PendingCount:  len(mset),
+			GapCount:      gaps,
+		}
+	}
+
+	return stats
+}
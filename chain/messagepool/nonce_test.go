@@ -0,0 +1,205 @@
+package messagepool
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/lotus/chain/messagepool/gasguess"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+	"github.com/filecoin-project/lotus/chain/wallet"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/filecoin-project/specs-actors/actors/crypto"
+)
+
+// TestHeadChangeNonceTracking checks that HeadChange both advances and
+// rewinds the per-actor next-nonce tracker correctly across a tipset
+// carrying more than one message from the same actor, and that applying
+// drops those messages from pending while reverting puts them back.
+func TestHeadChangeNonceTracking(t *testing.T) {
+	mp, tma := makeTestMpool()
+
+	w1, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a1, err := w1.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w2, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a2, err := w2.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gasLimit := gasguess.Costs[gasguess.CostKey{builtin.StorageMarketActorCodeID, 2}]
+
+	genesis := mock.MkBlock(nil, 1, 1)
+	tsGenesis := mock.TipSet(genesis)
+	mp.curTs = tsGenesis
+
+	child := mock.MkBlock(tsGenesis, 2, 1)
+	tsChild := mock.TipSet(child)
+
+	// three messages from a1, nonces 0-2, as if already included in tsChild.
+	onChain := []*types.SignedMessage{
+		makeTestMessage(w1, a1, a2, 0, gasLimit, 1),
+		makeTestMessage(w1, a1, a2, 1, gasLimit, 1),
+		makeTestMessage(w1, a1, a2, 2, gasLimit, 1),
+	}
+	tma.setTipSetMessages(tsChild, onChain...)
+
+	// a1 also has a not-yet-included message pending at nonce 3.
+	tma.setBalance(a1, 1)
+	pending := makeTestMessage(w1, a1, a2, 3, gasLimit, 1)
+	if err := mp.Add(pending); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mp.HeadChange(nil, []*types.TipSet{tsChild}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := mp.expectedNonce(a1); n != 3 {
+		t.Fatalf("expected next nonce 3 after apply, got %d", n)
+	}
+	if mset := mp.getPendingMset(a1); len(mset) != 1 {
+		t.Fatalf("expected only the still-pending nonce-3 message left, got %d", len(mset))
+	}
+
+	if err := mp.HeadChange([]*types.TipSet{tsChild}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := mp.expectedNonce(a1); n != 0 {
+		t.Fatalf("expected next nonce rewound to 0 after revert, got %d", n)
+	}
+	if mset := mp.getPendingMset(a1); len(mset) != 4 {
+		t.Fatalf("expected the reverted messages back in pending alongside the original one, got %d", len(mset))
+	}
+}
+
+// TestHeadChangeRevertRestoresBLSFromCache checks that a message reverted in
+// its bare *types.Message form -- the shape a BLS message actually comes
+// back as on chain, since its signature lives in the block's aggregate, not
+// on the message -- is still restored to pending using the signed form
+// applyNonces cached when it first removed it, rather than being dropped.
+func TestHeadChangeRevertRestoresBLSFromCache(t *testing.T) {
+	mp, tma := makeTestMpool()
+
+	w1, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a1, err := w1.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w2, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a2, err := w2.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gasLimit := gasguess.Costs[gasguess.CostKey{builtin.StorageMarketActorCodeID, 2}]
+
+	genesis := mock.MkBlock(nil, 1, 1)
+	tsGenesis := mock.TipSet(genesis)
+	mp.curTs = tsGenesis
+
+	child := mock.MkBlock(tsGenesis, 2, 1)
+	tsChild := mock.TipSet(child)
+
+	tma.setBalance(a1, 1)
+	signed := makeTestMessage(w1, a1, a2, 0, gasLimit, 1)
+	if err := mp.Add(signed); err != nil {
+		t.Fatal(err)
+	}
+
+	// applyNonces sees the fully signed message and caches it before
+	// dropping it from pending.
+	tma.setTipSetMessages(tsChild, signed)
+	if err := mp.HeadChange(nil, []*types.TipSet{tsChild}); err != nil {
+		t.Fatal(err)
+	}
+
+	if mset := mp.getPendingMset(a1); len(mset) != 0 {
+		t.Fatalf("expected pending to be empty after apply, got %d", len(mset))
+	}
+
+	// on revert, the chain store hands the message back in its bare,
+	// unsigned on-chain form.
+	tma.setTipSetChainMsgs(tsChild, &signed.Message)
+	if err := mp.HeadChange([]*types.TipSet{tsChild}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	mset := mp.getPendingMset(a1)
+	if len(mset) != 1 {
+		t.Fatalf("expected the reverted message restored to pending from the applied cache, got %d", len(mset))
+	}
+	if mset[0] != signed {
+		t.Fatal("expected the restored message to be the original signed message")
+	}
+}
+
+// TestHeadChangeRevertDropsUncachedBareMessage checks that a bare
+// *types.Message reverted with no corresponding cached signed form (e.g. it
+// was never in our own pending, because the node only started tracking the
+// pool after the message was first broadcast) is dropped rather than
+// crashing, since it has no signature we could restore.
+func TestHeadChangeRevertDropsUncachedBareMessage(t *testing.T) {
+	mp, tma := makeTestMpool()
+
+	w1, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a1, err := w1.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w2, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a2, err := w2.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gasLimit := gasguess.Costs[gasguess.CostKey{builtin.StorageMarketActorCodeID, 2}]
+
+	genesis := mock.MkBlock(nil, 1, 1)
+	tsGenesis := mock.TipSet(genesis)
+	mp.curTs = tsGenesis
+
+	child := mock.MkBlock(tsGenesis, 2, 1)
+	tsChild := mock.TipSet(child)
+
+	unseen := makeTestMessage(w1, a1, a2, 0, gasLimit, 1)
+	tma.setTipSetChainMsgs(tsChild, &unseen.Message)
+
+	if err := mp.HeadChange([]*types.TipSet{tsChild}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if mset := mp.getPendingMset(a1); len(mset) != 0 {
+		t.Fatalf("expected no message restored to pending with no signed form available, got %d", len(mset))
+	}
+}
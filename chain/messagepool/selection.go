@@ -0,0 +1,412 @@
+package messagepool
+
+import (
+	"context"
+	stdbig "math/big"
+	"sort"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+
+	"github.com/filecoin-project/lotus/build"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// MaxBlocks is the maximum number of blocks that can win a single epoch; a
+// message included in several of those blocks is only rewarded once, which
+// is what the optimal selection path accounts for.
+const MaxBlocks = 15
+
+// minGasLimit is the minimum GasLimit a message must carry to stand a
+// chance of executing at all; messages below it can never be included and
+// end the actor's message chain wherever they occur.
+const minGasLimit = 100
+
+// msgChain is a run of an actor's messages, contiguous in nonce, that must
+// be included together: a later message can never be selected without
+// first paying for everything ahead of it in the run.
+type msgChain struct {
+	msgs           []*types.SignedMessage
+	gasReward      big.Int
+	uncappedReward big.Int
+	gasCost        big.Int
+	gasLimit       int64
+	gasPerf        float64
+
+	// baseFeePenalty is the gap between gasPerf and what the chain's
+	// gasPerf would be if every message's premium were paid in full,
+	// uncapped by FeeCap-baseFee. A chain that's already being capped
+	// hard is one whose sender priced in room for the basefee to keep
+	// rising, which is exactly the kind of chain a competing miner is
+	// also likely to carry; selectMessagesOptimal uses it to discount
+	// such chains instead of just their raw (capped) gasPerf.
+	baseFeePenalty float64
+
+	effPerf      float64
+	bp           float64
+	parentOffset float64
+}
+
+// SelectMessages selects the set of messages to propose for inclusion in a
+// block built on top of ts. ticketQuality is the quality of the miner's
+// ticket for the epoch being proposed; above the threshold the miner is
+// all but guaranteed to produce the winning block for the epoch, so the
+// simpler greedy selection (pure gasPerf ordering) is optimal. Below the
+// threshold other miners may also win the epoch, so the optimal selection
+// is used instead, which discounts a chain's reward by the likelihood
+// that it will also be carried (and thus already rewarded) by a competing
+// winning block.
+//
+// Before either algorithm runs, chains belonging to the configured
+// PriorityAddrs are selected first, in the order PriorityAddrs lists
+// them, regardless of
+// gasPerf; the remaining gas is then filled by the normal selection.
+func (mp *MessagePool) SelectMessages(ctx context.Context, ts *types.TipSet, ticketQuality float64) ([]*types.SignedMessage, error) {
+	mp.lk.RLock()
+	defer mp.lk.RUnlock()
+
+	result, exclude, gasLimit := mp.selectPriorityMessages(ctx, ts)
+
+	var rest []*types.SignedMessage
+	var err error
+	if ticketQuality > 0.84 {
+		rest, err = mp.selectMessagesGreedy(ctx, ts, exclude, gasLimit)
+	} else {
+		rest, err = mp.selectMessagesOptimal(ctx, ts, ticketQuality, exclude, gasLimit)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return append(result, rest...), nil
+}
+
+// selectPriorityMessages selects, in full, the message chains of every
+// actor in PriorityAddrs that fit within the block gas limit. It returns
+// the selected messages, the set of actors to exclude from the normal
+// selection pass (every priority actor, whether or not its chain fit), and
+// the gas remaining for that pass.
+func (mp *MessagePool) selectPriorityMessages(ctx context.Context, ts *types.TipSet) ([]*types.SignedMessage, map[address.Address]struct{}, int64) {
+	result := make([]*types.SignedMessage, 0)
+	exclude := make(map[address.Address]struct{}, len(mp.cfg.PriorityAddrs))
+	gasLimit := int64(build.BlockGasLimit)
+
+	for _, actor := range mp.cfg.PriorityAddrs {
+		exclude[actor] = struct{}{}
+
+		mset, ok := mp.pending[actor]
+		if !ok {
+			continue
+		}
+
+		// createMessageChains returns an actor's chains in ascending nonce
+		// order; once one doesn't fit, every later chain for this actor has
+		// a higher nonce and depends on it having been included, so stop
+		// here instead of letting a cheaper, higher-nonce sibling slip in
+		// without its predecessor.
+		for _, chain := range mp.createMessageChains(ctx, actor, mset, ts) {
+			if chain.gasLimit > gasLimit {
+				break
+			}
+
+			gasLimit -= chain.gasLimit
+			result = append(result, chain.msgs...)
+		}
+	}
+
+	return result, exclude, gasLimit
+}
+
+func (mp *MessagePool) selectMessagesGreedy(ctx context.Context, ts *types.TipSet, exclude map[address.Address]struct{}, gasLimit int64) ([]*types.SignedMessage, error) {
+	chains := mp.allChains(ctx, ts, exclude)
+	sort.SliceStable(chains, func(i, j int) bool {
+		return chains[i].gasPerf > chains[j].gasPerf
+	})
+
+	// createMessageChains guarantees an actor's own chains never increase
+	// in gasPerf as nonce increases and returns them in nonce order, so a
+	// stable sort by gasPerf still visits each actor's chains in nonce
+	// order. Once one
+	// of an actor's chains is skipped for not fitting, every later chain
+	// of theirs depends on it (or an earlier sibling) having been
+	// included, so skip the rest of that actor's chains too instead of
+	// letting a cheaper, higher-nonce sibling slip in without it.
+	skip := make(map[address.Address]struct{})
+	result := make([]*types.SignedMessage, 0)
+	for _, chain := range chains {
+		from := chain.msgs[0].Message.From
+		if _, ok := skip[from]; ok {
+			continue
+		}
+
+		if chain.gasLimit > gasLimit {
+			skip[from] = struct{}{}
+			continue
+		}
+
+		gasLimit -= chain.gasLimit
+		result = append(result, chain.msgs...)
+	}
+
+	return result, nil
+}
+
+// selectMessagesOptimal repeatedly picks the chain with the highest
+// effective performance that still fits in the remaining gas, recomputing
+// the effective performance of the rest after every pick.
+func (mp *MessagePool) selectMessagesOptimal(ctx context.Context, ts *types.TipSet, ticketQuality float64, exclude map[address.Address]struct{}, gasLimit int64) ([]*types.SignedMessage, error) {
+	chains := mp.allChains(ctx, ts, exclude)
+
+	bp := blockProbability(ticketQuality)
+	for _, chain := range chains {
+		chain.bp = bp
+		chain.effPerf = effPerf(chain.gasPerf, bp, chain.baseFeePenalty)
+	}
+
+	result := make([]*types.SignedMessage, 0)
+	for len(chains) > 0 {
+		sort.Slice(chains, func(i, j int) bool {
+			return chains[i].effPerf > chains[j].effPerf
+		})
+
+		// an actor's chains can only be included in nonce order, so only
+		// each actor's lowest-nonce remaining chain is eligible; best is
+		// the eligible chain with the highest effPerf.
+		bestIdx := 0
+	eligible:
+		for i, chain := range chains {
+			for _, other := range chains {
+				if other.msgs[0].Message.From == chain.msgs[0].Message.From &&
+					other.msgs[0].Message.Nonce < chain.msgs[0].Message.Nonce {
+					continue eligible
+				}
+			}
+			bestIdx = i
+			break
+		}
+
+		best := chains[bestIdx]
+		if best.effPerf <= 0 {
+			break
+		}
+		if best.gasLimit > gasLimit {
+			// it doesn't fit. best is its actor's lowest-nonce remaining
+			// chain; every other remaining chain of theirs has a higher
+			// nonce and depends on this one having been included, so drop
+			// them all instead of falling through to a cheaper,
+			// higher-nonce sibling that would leave a nonce gap.
+			from := best.msgs[0].Message.From
+			remaining := make([]*msgChain, 0, len(chains)-1)
+			for _, chain := range chains {
+				if chain.msgs[0].Message.From != from {
+					remaining = append(remaining, chain)
+				}
+			}
+			chains = remaining
+			continue
+		}
+
+		chains = append(chains[:bestIdx], chains[bestIdx+1:]...)
+		result = append(result, best.msgs...)
+		gasLimit -= best.gasLimit
+
+		// a remaining chain from the same actor has had part of its
+		// stream cost already absorbed by the chain we just picked;
+		// propagate that via parentOffset so its effective performance
+		// reflects only the remaining, cheaper, portion of the stream.
+		for _, chain := range chains {
+			if chain.msgs[0].Message.From != best.msgs[0].Message.From {
+				continue
+			}
+			chain.parentOffset += best.gasPerf
+			chain.effPerf = effPerf(chain.gasPerf-chain.parentOffset, chain.bp, chain.baseFeePenalty)
+		}
+	}
+
+	return result, nil
+}
+
+// effPerf discounts perf by bp, the estimated probability that our block is
+// the only one to carry this chain, and penalizes it by baseFeePenalty
+// scaled by the complementary probability: the more likely a competing
+// winning block also carries the chain, the more its basefee risk -- rather
+// than its raw reward -- should weigh on whether it's worth including now.
+func effPerf(perf, bp, baseFeePenalty float64) float64 {
+	return bp*perf - (1-bp)*baseFeePenalty
+}
+
+// blockProbability estimates the probability that our block is the only
+// winning block in the epoch to carry a given chain. lambda is the
+// expected number of other winning blocks in the epoch given our ticket
+// quality; a smoothed Poisson-style weighting turns that into a
+// probability that decays towards 1/MaxBlocks as competition increases and
+// rises towards 1 as our ticket dominates.
+func blockProbability(ticketQuality float64) float64 {
+	lambda := (1 - ticketQuality) * (MaxBlocks - 1)
+	return 1 / (1 + lambda)
+}
+
+// allChains builds the per-actor message chains for every actor with
+// messages pending against ts, other than those in exclude (already
+// handled by the priority fast path).
+func (mp *MessagePool) allChains(ctx context.Context, ts *types.TipSet, exclude map[address.Address]struct{}) []*msgChain {
+	var chains []*msgChain
+
+	for actor, mset := range mp.pending {
+		if _, skip := exclude[actor]; skip {
+			continue
+		}
+		chains = append(chains, mp.createMessageChains(ctx, actor, mset, ts)...)
+	}
+
+	return chains
+}
+
+// createMessageChains builds the message chains for a single actor: the
+// contiguous run of messages starting at the actor's expected next nonce
+// is split wherever gasPerf does not increase along the chain (a pricier
+// later message gated by a cheaper earlier one is merged with it into a
+// single chain instead), and each resulting chain is trimmed
+// from the tail to fit both a single block's gas limit and the actor's
+// available balance.
+func (mp *MessagePool) createMessageChains(ctx context.Context, actor address.Address, mset map[uint64]*types.SignedMessage, ts *types.TipSet) []*msgChain {
+	curNonce, err := mp.getStateNonce(actor, ts)
+	if err != nil {
+		log.Warnf("failed to get nonce for %s: %s", actor, err)
+		return nil
+	}
+
+	balance, err := mp.getStateBalance(actor, ts)
+	if err != nil {
+		log.Warnf("failed to get balance for %s: %s", actor, err)
+		return nil
+	}
+
+	baseFee, err := mp.getStateBaseFee(ctx, ts)
+	if err != nil {
+		log.Warnf("failed to get basefee for %s: %s", actor, err)
+		return nil
+	}
+
+	msgs := make([]*types.SignedMessage, 0, len(mset))
+	for _, m := range mset {
+		msgs = append(msgs, m)
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Message.Nonce < msgs[j].Message.Nonce
+	})
+
+	// a message whose FeeCap can't even cover the current basefee has no
+	// chance of being included; it, and everything after it for this
+	// actor, ends the run just like a nonce gap would.
+	var run []*types.SignedMessage
+	for _, m := range msgs {
+		if m.Message.Nonce != curNonce || m.Message.GasLimit < minGasLimit || m.Message.GasFeeCap.LessThan(baseFee) {
+			break
+		}
+		run = append(run, m)
+		curNonce++
+	}
+
+	if len(run) == 0 {
+		return nil
+	}
+
+	chains := make([]*msgChain, 0, len(run))
+	for _, m := range run {
+		reward := gasReward(m, baseFee)
+		uncapped := uncappedGasReward(m)
+		cost := gasCost(m)
+		chains = append(chains, &msgChain{
+			msgs:           []*types.SignedMessage{m},
+			gasReward:      reward,
+			uncappedReward: uncapped,
+			gasCost:        cost,
+			gasLimit:       m.Message.GasLimit,
+			gasPerf:        gasPerf(reward, m.Message.GasLimit),
+		})
+	}
+
+	// merge adjacent chains, scanning from the head and starting over after
+	// each merge, whenever the earlier one has a lower gasPerf than the
+	// later one (chains of equal gasPerf stay separate): since the
+	// actor's messages must execute in nonce order, there's nothing to
+	// gain from keeping a cheap head separate from the pricier tail it
+	// gates.
+	for merged := true; merged; {
+		merged = false
+		for i := 0; i < len(chains)-1; i++ {
+			if chains[i].gasPerf < chains[i+1].gasPerf {
+				chains[i].msgs = append(chains[i].msgs, chains[i+1].msgs...)
+				chains[i].gasReward = big.Add(chains[i].gasReward, chains[i+1].gasReward)
+				chains[i].uncappedReward = big.Add(chains[i].uncappedReward, chains[i+1].uncappedReward)
+				chains[i].gasCost = big.Add(chains[i].gasCost, chains[i+1].gasCost)
+				chains[i].gasLimit += chains[i+1].gasLimit
+				chains[i].gasPerf = gasPerf(chains[i].gasReward, chains[i].gasLimit)
+				chains = append(chains[:i+1], chains[i+2:]...)
+				merged = true
+				break
+			}
+		}
+	}
+
+	result := make([]*msgChain, 0, len(chains))
+	for _, chain := range chains {
+		for len(chain.msgs) > 0 &&
+			(chain.gasLimit > build.BlockGasLimit || chain.gasCost.GreaterThan(balance) || chain.gasPerf < 0) {
+			last := chain.msgs[len(chain.msgs)-1]
+			chain.msgs = chain.msgs[:len(chain.msgs)-1]
+			chain.gasReward = big.Sub(chain.gasReward, gasReward(last, baseFee))
+			chain.uncappedReward = big.Sub(chain.uncappedReward, uncappedGasReward(last))
+			chain.gasCost = big.Sub(chain.gasCost, gasCost(last))
+			chain.gasLimit -= last.Message.GasLimit
+			chain.gasPerf = gasPerf(chain.gasReward, chain.gasLimit)
+		}
+		if len(chain.msgs) == 0 {
+			continue
+		}
+		chain.baseFeePenalty = gasPerf(chain.uncappedReward, chain.gasLimit) - chain.gasPerf
+		result = append(result, chain)
+	}
+
+	return result
+}
+
+// gasReward is what the miner actually collects for including m: the
+// per-unit premium the sender offered, capped by what's left of the
+// FeeCap once the basefee is burned.
+func gasReward(m *types.SignedMessage, baseFee big.Int) big.Int {
+	premium := m.Message.GasPremium
+	feeCapMinusBaseFee := big.Sub(m.Message.GasFeeCap, baseFee)
+	if feeCapMinusBaseFee.LessThan(premium) {
+		premium = feeCapMinusBaseFee
+	}
+
+	return big.Mul(premium, big.NewInt(m.Message.GasLimit))
+}
+
+// uncappedGasReward is what gasReward would be if the sender's premium were
+// paid in full, ignoring any cap imposed by FeeCap-baseFee. The gap between
+// this and the actual (capped) gasReward is how much headroom the sender
+// left before the basefee starts eating into their premium.
+func uncappedGasReward(m *types.SignedMessage) big.Int {
+	return big.Mul(m.Message.GasPremium, big.NewInt(m.Message.GasLimit))
+}
+
+// gasCost is the maximum the sender can possibly be charged for m, used to
+// check the cost against the actor's balance; it ignores the basefee since
+// the sender must have the funds set aside regardless of how much of the
+// FeeCap actually gets burned.
+func gasCost(m *types.SignedMessage) big.Int {
+	return big.Mul(m.Message.GasFeeCap, big.NewInt(m.Message.GasLimit))
+}
+
+func gasPerf(reward big.Int, gasLimit int64) float64 {
+	if gasLimit == 0 {
+		return 0
+	}
+
+	r := new(stdbig.Rat).SetFrac(reward.Int, stdbig.NewInt(gasLimit))
+	f, _ := r.Float64()
+	return f
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/lotus/build"
 	"github.com/filecoin-project/lotus/chain/messagepool/gasguess"
 	"github.com/filecoin-project/lotus/chain/types"
@@ -18,15 +19,24 @@ import (
 	_ "github.com/filecoin-project/lotus/lib/sigs/secp"
 )
 
-func makeTestMessage(w *wallet.Wallet, from, to address.Address, nonce uint64, gasLimit int64, gasPrice uint64) *types.SignedMessage {
+// makeTestMessage builds a message with GasPremium and GasFeeCap both set to
+// gasPremium, i.e. one whose premium is capped only when the basefee is
+// non-zero; use
+// makeTestMessageWithFeeCap for cases that need the two to diverge.
+func makeTestMessage(w *wallet.Wallet, from, to address.Address, nonce uint64, gasLimit int64, gasPremium uint64) *types.SignedMessage {
+	return makeTestMessageWithFeeCap(w, from, to, nonce, gasLimit, gasPremium, gasPremium)
+}
+
+func makeTestMessageWithFeeCap(w *wallet.Wallet, from, to address.Address, nonce uint64, gasLimit int64, gasPremium, gasFeeCap uint64) *types.SignedMessage {
 	msg := &types.Message{
-		From:     from,
-		To:       to,
-		Method:   2,
-		Value:    types.FromFil(0),
-		Nonce:    nonce,
-		GasLimit: gasLimit,
-		GasPrice: types.NewInt(gasPrice),
+		From:       from,
+		To:         to,
+		Method:     2,
+		Value:      types.FromFil(0),
+		Nonce:      nonce,
+		GasLimit:   gasLimit,
+		GasPremium: types.NewInt(gasPremium),
+		GasFeeCap:  types.NewInt(gasFeeCap),
 	}
 	sig, err := w.Sign(context.TODO(), from, msg.Cid().Bytes())
 	if err != nil {
@@ -90,7 +100,7 @@ func TestMessageChains(t *testing.T) {
 		mset[uint64(i)] = m
 	}
 
-	chains := mp.createMessageChains(a1, mset, ts)
+	chains := mp.createMessageChains(context.TODO(), a1, mset, ts)
 	if len(chains) != 1 {
 		t.Fatal("expected a single chain")
 	}
@@ -111,7 +121,7 @@ func TestMessageChains(t *testing.T) {
 		mset[uint64(i)] = m
 	}
 
-	chains = mp.createMessageChains(a1, mset, ts)
+	chains = mp.createMessageChains(context.TODO(), a1, mset, ts)
 	if len(chains) != 10 {
 		t.Fatal("expected 10 chains")
 	}
@@ -135,7 +145,7 @@ func TestMessageChains(t *testing.T) {
 		mset[uint64(i)] = m
 	}
 
-	chains = mp.createMessageChains(a1, mset, ts)
+	chains = mp.createMessageChains(context.TODO(), a1, mset, ts)
 	if len(chains) != 4 {
 		t.Fatal("expected 4 chains")
 	}
@@ -168,7 +178,7 @@ func TestMessageChains(t *testing.T) {
 		mset[uint64(i)] = m
 	}
 
-	chains = mp.createMessageChains(a1, mset, ts)
+	chains = mp.createMessageChains(context.TODO(), a1, mset, ts)
 	if len(chains) != 1 {
 		t.Fatal("expected a single chain")
 	}
@@ -194,7 +204,7 @@ func TestMessageChains(t *testing.T) {
 		mset[uint64(i)] = m
 	}
 
-	chains = mp.createMessageChains(a1, mset, ts)
+	chains = mp.createMessageChains(context.TODO(), a1, mset, ts)
 	if len(chains) != 1 {
 		t.Fatal("expected a single chain")
 	}
@@ -217,7 +227,7 @@ func TestMessageChains(t *testing.T) {
 		mset[uint64(i)] = makeTestMessage(w1, a1, a2, uint64(i), gasLimit, uint64(i+1))
 	}
 
-	chains = mp.createMessageChains(a1, mset, ts)
+	chains = mp.createMessageChains(context.TODO(), a1, mset, ts)
 	if len(chains) != 1 {
 		t.Fatal("expected a single chain")
 	}
@@ -238,7 +248,7 @@ func TestMessageChains(t *testing.T) {
 		mset[uint64(i)] = makeTestMessage(w1, a1, a2, uint64(i), gasLimit, uint64(i+1))
 	}
 
-	chains = mp.createMessageChains(a1, mset, ts)
+	chains = mp.createMessageChains(context.TODO(), a1, mset, ts)
 	if len(chains) != 1 {
 		t.Fatal("expected a single chain")
 	}
@@ -252,3 +262,486 @@ func TestMessageChains(t *testing.T) {
 	}
 
 }
+
+// TestMessageSelectionOptimal checks that SelectMessages dispatches between
+// the greedy and the optimal algorithm based on ticket quality, and that
+// the optimal path actually discounts a chain exposed to basefee risk
+// instead of just reproducing the greedy (pure gasPerf) ordering.
+func TestMessageSelectionOptimal(t *testing.T) {
+	mp, tma := makeTestMpool()
+
+	w1, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a1, err := w1.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w2, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a2, err := w2.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := mock.MkBlock(nil, 1, 1)
+	ts := mock.TipSet(block)
+	mp.curTs = ts
+
+	gasLimit := gasguess.Costs[gasguess.CostKey{builtin.StorageMarketActorCodeID, 2}]
+
+	tma.setBalance(a1, 1)
+	tma.setBalance(a2, 1)
+	tma.setBaseFee(types.NewInt(10))
+
+	// a1's premium never gets capped by FeeCap-baseFee: its gasPerf is
+	// modest but carries no basefee risk. a2 asks for a much higher
+	// premium but leaves only a thin FeeCap margin over the basefee, so
+	// its actual (capped) gasPerf beats a1's while its uncapped,
+	// premium-implied gasPerf is enormously higher still -- a large
+	// baseFeePenalty. The greedy path only sees the capped gasPerf and
+	// must rank a2 first; the optimal path must weigh a2's basefee risk
+	// heavily enough, at low ticket quality, to drop it in favor of a1.
+	if err := mp.Add(makeTestMessageWithFeeCap(w1, a1, a2, 0, gasLimit, 5, 20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mp.Add(makeTestMessageWithFeeCap(w2, a2, a1, 0, gasLimit, 1000, 120)); err != nil {
+		t.Fatal(err)
+	}
+
+	greedy, err := mp.SelectMessages(context.TODO(), ts, 0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(greedy) != 2 || greedy[0].Message.From != a2 {
+		t.Fatal("expected the greedy path to rank a2's higher (capped) gasPerf chain first")
+	}
+
+	optimal, err := mp.SelectMessages(context.TODO(), ts, 0.2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(optimal) != 1 || optimal[0].Message.From != a1 {
+		t.Fatalf("expected the optimal path to discount a2's basefee-risky chain out entirely and keep only a1's, got %d messages", len(optimal))
+	}
+}
+
+// TestMessageSelectionNonceContiguity checks that neither selection path
+// selects a higher-nonce chain for an actor whose lower-nonce, cheaper-to-
+// include chain was dropped for not fitting the remaining gas: no valid
+// block can execute a later nonce without the ones ahead of it.
+func TestMessageSelectionNonceContiguity(t *testing.T) {
+	mp, tma := makeTestMpool()
+
+	w1, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a1, err := w1.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w2, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a2, err := w2.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := mock.MkBlock(nil, 1, 1)
+	ts := mock.TipSet(block)
+	mp.curTs = ts
+
+	tma.setBalance(a1, 1000)
+	tma.setBalance(a2, 1000)
+
+	// a2 has one chain that takes half the block; a1 has two unmerged
+	// chains (decreasing gasPerf, so they don't merge into one) where the
+	// first alone takes 90% of the block and the second only 10%. Once a2
+	// is selected there's only 50% of the block left: a1's first chain no
+	// longer fits, and its second must not be selected in its place.
+	gasA2 := int64(float64(build.BlockGasLimit) * 0.5)
+	gasA1n0 := int64(float64(build.BlockGasLimit) * 0.9)
+	gasA1n1 := int64(float64(build.BlockGasLimit) * 0.1)
+
+	if err := mp.Add(makeTestMessage(w2, a2, a1, 0, gasA2, 200)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mp.Add(makeTestMessage(w1, a1, a2, 0, gasA1n0, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mp.Add(makeTestMessage(w1, a1, a2, 1, gasA1n1, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tq := range []float64{0.9, 0.2} {
+		selected, err := mp.SelectMessages(context.TODO(), ts, tq)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sawNonce := map[uint64]bool{}
+		for _, m := range selected {
+			if m.Message.From == a1 {
+				sawNonce[m.Message.Nonce] = true
+			}
+		}
+		if sawNonce[1] && !sawNonce[0] {
+			t.Fatalf("tq=%.1f: selected a1's nonce 1 message without its predecessor nonce 0", tq)
+		}
+	}
+}
+
+// TestMessageChainsBaseFee checks that createMessageChains accounts for a
+// non-zero basefee: a chain whose head can't cover the basefee is dropped
+// entirely, a chain breaks where a later message's FeeCap falls below the
+// basefee, and a FeeCap that clips the premium yields a lower gasPerf than
+// the premium alone would suggest.
+func TestMessageChainsBaseFee(t *testing.T) {
+	mp, tma := makeTestMpool()
+
+	w1, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a1, err := w1.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w2, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a2, err := w2.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := mock.MkBlock(nil, 1, 1)
+	ts := mock.TipSet(block)
+
+	gasLimit := gasguess.Costs[gasguess.CostKey{builtin.StorageMarketActorCodeID, 2}]
+
+	tma.setBalance(a1, 1)
+	tma.setBaseFee(types.NewInt(100))
+
+	// test1: the head message's FeeCap can't even cover the basefee, so the
+	// whole run is dropped.
+	mset := make(map[uint64]*types.SignedMessage)
+	for i := 0; i < 10; i++ {
+		mset[uint64(i)] = makeTestMessageWithFeeCap(w1, a1, a2, uint64(i), gasLimit, uint64(i+1), 50)
+	}
+
+	chains := mp.createMessageChains(context.TODO(), a1, mset, ts)
+	if len(chains) != 0 {
+		t.Fatalf("expected no chains, but got %d", len(chains))
+	}
+
+	// test2: the middle message's FeeCap falls below the basefee, breaking
+	// the chain at that nonce.
+	mset = make(map[uint64]*types.SignedMessage)
+	for i := 0; i < 10; i++ {
+		feeCap := uint64(1000)
+		if i == 5 {
+			feeCap = 50
+		}
+		mset[uint64(i)] = makeTestMessageWithFeeCap(w1, a1, a2, uint64(i), gasLimit, uint64(i+1), feeCap)
+	}
+
+	chains = mp.createMessageChains(context.TODO(), a1, mset, ts)
+	if len(chains) != 1 {
+		t.Fatalf("expected a single chain, but got %d", len(chains))
+	}
+	if len(chains[0].msgs) != 5 {
+		t.Fatalf("expected 5 messages in the chain but got %d", len(chains[0].msgs))
+	}
+
+	// test3: the premium is capped by FeeCap-baseFee, so gasPerf must come
+	// out lower than the naive (uncapped) premium would suggest.
+	mset = make(map[uint64]*types.SignedMessage)
+	mset[0] = makeTestMessageWithFeeCap(w1, a1, a2, 0, gasLimit, 1000, 150)
+
+	chains = mp.createMessageChains(context.TODO(), a1, mset, ts)
+	if len(chains) != 1 {
+		t.Fatalf("expected a single chain, but got %d", len(chains))
+	}
+
+	uncapped := gasPerf(big.Mul(types.NewInt(1000), big.NewInt(gasLimit)), gasLimit)
+	if chains[0].gasPerf >= uncapped {
+		t.Fatalf("expected gasPerf %f to be less than the uncapped premium gasPerf %f", chains[0].gasPerf, uncapped)
+	}
+}
+
+// TestMessageSelectionPriority checks that PriorityAddrs are selected
+// ahead of everything else, even when a non-priority actor offers a much
+// higher gasPerf.
+func TestMessageSelectionPriority(t *testing.T) {
+	mp, tma := makeTestMpool()
+
+	w1, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a1, err := w1.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w2, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a2, err := w2.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := mock.MkBlock(nil, 1, 1)
+	ts := mock.TipSet(block)
+	mp.curTs = ts
+
+	gasLimit := gasguess.Costs[gasguess.CostKey{builtin.StorageMarketActorCodeID, 2}]
+
+	tma.setBalance(a1, 1)
+	tma.setBalance(a2, 1)
+
+	if err := mp.MpoolSetConfig(&MpoolConfig{PriorityAddrs: []address.Address{a1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a1 (priority) offers a low gasPerf; a2 (not priority) offers a much
+	// higher one. a1's chain must still come first in the selection.
+	if err := mp.Add(makeTestMessage(w1, a1, a2, 0, gasLimit, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mp.Add(makeTestMessage(w2, a2, a1, 0, gasLimit, 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	selected, err := mp.SelectMessages(context.TODO(), ts, 0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(selected))
+	}
+	if selected[0].Message.From != a1 {
+		t.Fatalf("expected a1's priority message to be selected first")
+	}
+}
+
+// TestMessageSelectionPriorityNonceContiguity checks that
+// selectPriorityMessages doesn't select a higher-nonce chain for a
+// priority actor whose lower-nonce chain was dropped for not fitting the
+// gas remaining after an earlier priority actor's messages.
+func TestMessageSelectionPriorityNonceContiguity(t *testing.T) {
+	mp, tma := makeTestMpool()
+
+	w0, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a0, err := w0.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w1, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a1, err := w1.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w2, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a2, err := w2.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := mock.MkBlock(nil, 1, 1)
+	ts := mock.TipSet(block)
+	mp.curTs = ts
+
+	tma.setBalance(a0, 1000)
+	tma.setBalance(a1, 1000)
+
+	if err := mp.MpoolSetConfig(&MpoolConfig{PriorityAddrs: []address.Address{a0, a1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a0 (priority, processed first) eats almost the whole block; a1
+	// (priority, processed second) has two unmerged chains where only the
+	// cheaper, higher-nonce one would fit in what's left.
+	gasA0 := int64(float64(build.BlockGasLimit) * 0.95)
+	gasA1n0 := int64(float64(build.BlockGasLimit) * 0.1)
+	gasA1n1 := int64(float64(build.BlockGasLimit) * 0.01)
+
+	if err := mp.Add(makeTestMessage(w0, a0, a2, 0, gasA0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mp.Add(makeTestMessage(w1, a1, a2, 0, gasA1n0, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mp.Add(makeTestMessage(w1, a1, a2, 1, gasA1n1, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	selected, err := mp.SelectMessages(context.TODO(), ts, 0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sawNonce := map[uint64]bool{}
+	for _, m := range selected {
+		if m.Message.From == a1 {
+			sawNonce[m.Message.Nonce] = true
+		}
+	}
+	if sawNonce[1] && !sawNonce[0] {
+		t.Fatal("selected a1's nonce 1 message without its predecessor nonce 0")
+	}
+}
+
+// TestSelectMessagesByTsk checks that SelectMessagesByTsk resolves a
+// TipSetKey through the chain store and then behaves exactly like
+// SelectMessages against the resolved tipset.
+func TestSelectMessagesByTsk(t *testing.T) {
+	mp, tma := makeTestMpool()
+
+	w1, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a1, err := w1.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w2, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a2, err := w2.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := mock.MkBlock(nil, 1, 1)
+	ts := mock.TipSet(block)
+	mp.curTs = ts
+	tma.addTipSet(ts)
+
+	gasLimit := gasguess.Costs[gasguess.CostKey{builtin.StorageMarketActorCodeID, 2}]
+	tma.setBalance(a1, 1)
+
+	if err := mp.Add(makeTestMessage(w1, a1, a2, 0, gasLimit, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	selected, err := mp.SelectMessagesByTsk(context.TODO(), ts.Key(), 0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(selected))
+	}
+
+	if _, err := mp.SelectMessagesByTsk(context.TODO(), types.TipSetKey{}, 0.9); err == nil {
+		t.Fatal("expected an error resolving an unknown tipset key")
+	}
+}
+
+// TestNonceGapRejection checks that Add rejects a message whose nonce is
+// further than MaxNonceGap past the actor's expected nonce, while the
+// messages within the gap are accepted and still chain together.
+func TestNonceGapRejection(t *testing.T) {
+	mp, tma := makeTestMpool()
+
+	w1, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a1, err := w1.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w2, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a2, err := w2.GenerateKey(crypto.SigTypeBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := mock.MkBlock(nil, 1, 1)
+	ts := mock.TipSet(block)
+	mp.curTs = ts
+
+	gasLimit := gasguess.Costs[gasguess.CostKey{builtin.StorageMarketActorCodeID, 2}]
+	tma.setBalance(a1, 1)
+
+	for _, nonce := range []uint64{0, 1, 2} {
+		if err := mp.Add(makeTestMessage(w1, a1, a2, nonce, gasLimit, nonce+1)); err != nil {
+			t.Fatalf("unexpected rejection of nonce %d: %s", nonce, err)
+		}
+	}
+
+	err = mp.Add(makeTestMessage(w1, a1, a2, 100, gasLimit, 101))
+	if err == nil {
+		t.Fatal("expected nonce 100 to be rejected for exceeding the max nonce gap")
+	}
+	if _, ok := err.(*ErrNonceGap); !ok {
+		t.Fatalf("expected an *ErrNonceGap, got %T: %s", err, err)
+	}
+
+	chains := mp.createMessageChains(context.TODO(), a1, mp.getPendingMset(a1), ts)
+	if len(chains) != 1 {
+		t.Fatalf("expected a single chain, but got %d", len(chains))
+	}
+	if len(chains[0].msgs) != 3 {
+		t.Fatalf("expected 3 messages in the chain but got %d", len(chains[0].msgs))
+	}
+
+	stats := mp.MpoolPendingStats()
+	s, ok := stats[a1]
+	if !ok {
+		t.Fatal("expected pending stats for a1")
+	}
+	if s.PendingCount != 3 {
+		t.Fatalf("expected 3 pending messages, got %d", s.PendingCount)
+	}
+	if s.GapCount != 0 {
+		t.Fatalf("expected no gaps, got %d", s.GapCount)
+	}
+}